@@ -0,0 +1,39 @@
+// Package cloud abstracts the handful of VM lifecycle operations icecloud
+// needs, so that the provisioning logic in package main can be tested
+// without talking to a real cloud provider.
+package cloud
+
+// VM describes a single virtual machine instance.
+type VM struct {
+	ID      string // provider-specific instance ID
+	DNSName string // public DNS name, once assigned
+	State   string // provider-specific state, e.g. "pending", "running", "terminated"
+}
+
+// CreateOptions describes the VM to create. UserData, if set, is passed
+// to the instance unencoded; implementations are responsible for any
+// encoding the provider's API requires.
+type CreateOptions struct {
+	ImageID      string
+	InstanceType string
+	KeyName      string
+	Region       string
+	UserData     []byte
+}
+
+// VMClient creates and manages VMs on a cloud provider.
+type VMClient interface {
+	// Create launches a new VM and returns it, typically in a
+	// "pending" or "running" state depending on the provider.
+	Create(opts CreateOptions) (*VM, error)
+
+	// Describe returns the current state of the VM with the given ID.
+	Describe(id, region string) (*VM, error)
+
+	// Terminate shuts down and releases the VM with the given ID.
+	Terminate(id, region string) error
+
+	// WaitRunning blocks until the VM with the given ID is confirmed
+	// healthy and running, and returns its current state.
+	WaitRunning(id, region string) (*VM, error)
+}
@@ -0,0 +1,145 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"golang.org/x/oauth2"
+)
+
+// DOClient is a VMClient backed by DigitalOcean droplets.
+type DOClient struct {
+	Token string // DigitalOcean API token
+
+	// SSHPublicKey, if set, is registered under the requested KeyName
+	// the first time it's needed, so a fresh DigitalOcean account
+	// doesn't need the key added out of band before droplets can boot
+	// with it. If empty, the key is assumed to already exist.
+	SSHPublicKey string
+
+	mu     sync.Mutex
+	client *godo.Client
+}
+
+// godoClient is called concurrently, once per server, by Run and Setup's
+// per-server goroutines, so the lazily-built client needs a lock.
+func (c *DOClient) godoClient() *godo.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		ts := tokenSource{c.Token}
+		c.client = godo.NewClient(oauth2.NewClient(context.Background(), ts))
+	}
+	return c.client
+}
+
+type tokenSource struct {
+	token string
+}
+
+func (t tokenSource) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: t.token}, nil
+}
+
+func (c *DOClient) Create(opts CreateOptions) (*VM, error) {
+	ctx := context.Background()
+	key, err := c.sshKey(ctx, opts.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	req := &godo.DropletCreateRequest{
+		Name:     fmt.Sprintf("icecloud-%s", opts.InstanceType),
+		Region:   opts.Region,
+		Size:     opts.InstanceType,
+		Image:    godo.DropletCreateImage{Slug: opts.ImageID},
+		SSHKeys:  []godo.DropletCreateSSHKey{{ID: key.ID, Fingerprint: key.Fingerprint}},
+		UserData: string(opts.UserData),
+	}
+	d, _, err := c.godoClient().Droplets.Create(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return vmFromDroplet(d), nil
+}
+
+// sshKey returns the DigitalOcean key named name, registering
+// SSHPublicKey under that name first if it isn't already on file.
+// godo identifies a droplet's keys by ID or fingerprint, not name, so
+// callers need the returned key itself rather than just knowing it
+// exists.
+func (c *DOClient) sshKey(ctx context.Context, name string) (*godo.Key, error) {
+	svc := c.godoClient().Keys
+	keys, _, err := svc.List(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if k.Name == name {
+			return &k, nil
+		}
+	}
+	if c.SSHPublicKey == "" {
+		return nil, fmt.Errorf("cloud: no SSH key named %q on file and no SSHPublicKey to register one", name)
+	}
+	key, _, err := svc.Create(ctx, &godo.KeyCreateRequest{
+		Name:      name,
+		PublicKey: c.SSHPublicKey,
+	})
+	return key, err
+}
+
+func (c *DOClient) Describe(id, region string) (*VM, error) {
+	did, err := parseDropletID(id)
+	if err != nil {
+		return nil, err
+	}
+	d, _, err := c.godoClient().Droplets.Get(context.Background(), did)
+	if err != nil {
+		return nil, err
+	}
+	return vmFromDroplet(d), nil
+}
+
+func (c *DOClient) Terminate(id, region string) error {
+	did, err := parseDropletID(id)
+	if err != nil {
+		return err
+	}
+	_, err = c.godoClient().Droplets.Delete(context.Background(), did)
+	return err
+}
+
+func (c *DOClient) WaitRunning(id, region string) (*VM, error) {
+	deadline := time.Now().Add(5 * time.Minute)
+	for time.Now().Before(deadline) {
+		vm, err := c.Describe(id, region)
+		if err != nil {
+			return nil, err
+		}
+		if vm.State == "active" {
+			return vm, nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return nil, fmt.Errorf("cloud: droplet %s took too long to become active", id)
+}
+
+func vmFromDroplet(d *godo.Droplet) *VM {
+	vm := &VM{ID: strconv.Itoa(d.ID), State: d.Status}
+	if ip, err := d.PublicIPv4(); err == nil {
+		vm.DNSName = ip
+	}
+	return vm
+}
+
+func parseDropletID(id string) (int, error) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, fmt.Errorf("cloud: invalid droplet id %q: %v", id, err)
+	}
+	return n, nil
+}
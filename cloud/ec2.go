@@ -0,0 +1,123 @@
+package cloud
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2Client is a VMClient backed by Amazon EC2. Credentials are resolved
+// through the standard AWS chain (environment variables, a profile from
+// ~/.aws/credentials, EC2 instance metadata), optionally followed by an
+// STS AssumeRole if RoleARN is set.
+type EC2Client struct {
+	Profile string // ~/.aws/credentials profile to use, or "" for the default chain
+	RoleARN string // if set, assume this role before using the resolved credentials
+
+	mu       sync.Mutex
+	sessions map[string]*session.Session // region -> session, built lazily
+}
+
+// sessionFor is called concurrently, once per server, by Run and Setup's
+// per-server goroutines, so the lazily-built session cache needs a lock.
+func (c *EC2Client) sessionFor(region string) (*session.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.sessions[region]; ok {
+		return s, nil
+	}
+	s, err := session.NewSessionWithOptions(session.Options{
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(region)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.RoleARN != "" {
+		s = s.Copy(&aws.Config{Credentials: stscreds.NewCredentials(s, c.RoleARN)})
+	}
+	if c.sessions == nil {
+		c.sessions = make(map[string]*session.Session)
+	}
+	c.sessions[region] = s
+	return s, nil
+}
+
+func (c *EC2Client) Create(opts CreateOptions) (*VM, error) {
+	sess, err := c.sessionFor(opts.Region)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ec2.New(sess).RunInstances(&ec2.RunInstancesInput{
+		ImageId:      aws.String(opts.ImageID),
+		InstanceType: aws.String(opts.InstanceType),
+		KeyName:      aws.String(opts.KeyName),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+		UserData:     aws.String(base64.StdEncoding.EncodeToString(opts.UserData)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Instances) != 1 {
+		return nil, fmt.Errorf("cloud: want 1 instance, got %d", len(resp.Instances))
+	}
+	return vmFromInstance(resp.Instances[0]), nil
+}
+
+func (c *EC2Client) Describe(id, region string) (*VM, error) {
+	sess, err := c.sessionFor(region)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ec2.New(sess).DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Reservations) != 1 || len(resp.Reservations[0].Instances) != 1 {
+		return nil, fmt.Errorf("cloud: instance %s not found", id)
+	}
+	return vmFromInstance(resp.Reservations[0].Instances[0]), nil
+}
+
+func (c *EC2Client) Terminate(id, region string) error {
+	sess, err := c.sessionFor(region)
+	if err != nil {
+		return err
+	}
+	_, err = ec2.New(sess).TerminateInstances(&ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	return err
+}
+
+func (c *EC2Client) WaitRunning(id, region string) (*VM, error) {
+	sess, err := c.sessionFor(region)
+	if err != nil {
+		return nil, err
+	}
+	input := &ec2.DescribeInstanceStatusInput{InstanceIds: []*string{aws.String(id)}}
+	if err := ec2.New(sess).WaitUntilInstanceStatusOk(input); err != nil {
+		return nil, err
+	}
+	return c.Describe(id, region)
+}
+
+func vmFromInstance(inst *ec2.Instance) *VM {
+	vm := &VM{ID: aws.StringValue(inst.InstanceId)}
+	if inst.State != nil {
+		vm.State = aws.StringValue(inst.State.Name)
+	}
+	if inst.PublicDnsName != nil {
+		vm.DNSName = *inst.PublicDnsName
+	}
+	return vm
+}
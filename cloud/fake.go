@@ -0,0 +1,62 @@
+package cloud
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeClient is an in-memory VMClient for tests. It never touches the
+// network; Create assigns each VM a synthetic ID and DNS name and marks
+// it "running" immediately.
+type FakeClient struct {
+	mu     sync.Mutex
+	nextID int
+	vms    map[string]*VM
+}
+
+func (c *FakeClient) Create(opts CreateOptions) (*VM, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.vms == nil {
+		c.vms = make(map[string]*VM)
+	}
+	c.nextID++
+	id := fmt.Sprintf("i-fake%d", c.nextID)
+	vm := &VM{
+		ID:      id,
+		DNSName: fmt.Sprintf("%s.example.com", id),
+		State:   "running",
+	}
+	c.vms[id] = vm
+	return copyVM(vm), nil
+}
+
+func (c *FakeClient) Describe(id, region string) (*VM, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vm, ok := c.vms[id]
+	if !ok {
+		return nil, fmt.Errorf("cloud: instance %s not found", id)
+	}
+	return copyVM(vm), nil
+}
+
+func (c *FakeClient) Terminate(id, region string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vm, ok := c.vms[id]
+	if !ok {
+		return fmt.Errorf("cloud: instance %s not found", id)
+	}
+	vm.State = "terminated"
+	return nil
+}
+
+func (c *FakeClient) WaitRunning(id, region string) (*VM, error) {
+	return c.Describe(id, region)
+}
+
+func copyVM(vm *VM) *VM {
+	cp := *vm
+	return &cp
+}
@@ -0,0 +1,37 @@
+package cloud
+
+import "testing"
+
+func TestFakeClientLifecycle(t *testing.T) {
+	c := new(FakeClient)
+	vm, err := c.Create(CreateOptions{ImageID: "ami-test", Region: "us-east-1"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if vm.State != "running" || vm.DNSName == "" {
+		t.Fatalf("Create returned %+v, want running with a DNS name", vm)
+	}
+
+	got, err := c.Describe(vm.ID, "us-east-1")
+	if err != nil {
+		t.Fatalf("Describe: %v", err)
+	}
+	if *got != *vm {
+		t.Fatalf("Describe = %+v, want %+v", got, vm)
+	}
+
+	if err := c.Terminate(vm.ID, "us-east-1"); err != nil {
+		t.Fatalf("Terminate: %v", err)
+	}
+	got, err = c.Describe(vm.ID, "us-east-1")
+	if err != nil {
+		t.Fatalf("Describe after Terminate: %v", err)
+	}
+	if got.State != "terminated" {
+		t.Fatalf("State = %q, want terminated", got.State)
+	}
+
+	if _, err := c.Describe("i-nonexistent", "us-east-1"); err == nil {
+		t.Fatal("Describe of unknown instance: got nil error")
+	}
+}
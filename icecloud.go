@@ -2,28 +2,63 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
-	"launchpad.net/goamz/aws"
-	"launchpad.net/goamz/ec2"
+	"github.com/nf/icecloud/cloud"
 )
 
+// shutdownGracePeriod bounds how long a Ctrl-C (or other termination
+// signal) waits for in-flight provisioning work to unwind on its own
+// before instances are force-terminated anyway.
+const shutdownGracePeriod = 30 * time.Second
+
 type Config struct {
 	KeyName string
+	Profile string // ~/.aws/credentials profile to use, or "" for the default chain
+	RoleARN string // if set, assume this role via STS before provisioning
+
+	DOToken      string // DigitalOcean API token, for servers with Provider "digitalocean"
+	SSHPublicKey string // registered as KeyName on DigitalOcean if not already present
+
 	Server  []*Server
 	Icecast *Icecast
 
-	auth aws.Auth
+	vms map[string]cloud.VMClient // provider name -> client
+
+	// checkIcecast overrides how readiness is determined for a server;
+	// nil means use the real HTTP check against status-json.xsl. Tests
+	// set this to avoid making network calls.
+	checkIcecast func(*Server) bool
+
+	// mu guards Server and each Server's Instance against the
+	// concurrent access the HTTP control API (see server.go) and the
+	// per-server goroutines in Run and Setup can both make.
+	mu sync.Mutex
+
+	// stateFile, if set, is where a signal-triggered shutdown or a
+	// Serve-driven instance termination persists state, since neither
+	// path returns control to main's own config.Write call. Set by
+	// main; left empty (and so inert) in tests.
+	stateFile string
+
+	// shutdownOnce ensures Shutdown runs at most once per Config: a
+	// termination signal landing mid-Run can otherwise race the
+	// Shutdown call Run's own error handling makes.
+	shutdownOnce sync.Once
 }
 
 type Icecast struct {
@@ -37,19 +72,29 @@ type Server struct {
 	Name string
 
 	Kind     string // "master" or "slave"
-	Location string // to be translated through the Locations map
+	Provider string // "ec2" (default) or "digitalocean"
+	Location string // to be translated through the provider's location table
 
-	Username string // login name
+	Username string // login name, for manual SSH access only
 	ImageID  string // must be available at this location
-	Size     string // something like "t1.micro"
+	Size     string // something like "t1.micro", or a droplet size slug
 
 	NumClients, NumSources int // numbers of icecast clients and sources
 
-	Instance *ec2.Instance
+	Instance *cloud.VM
 }
 
-func (s *Server) Region() aws.Region {
-	r, ok := Locations[s.Location]
+// locations returns the location table to translate this server's
+// Location through, based on its Provider.
+func (s *Server) locations() map[string]string {
+	if s.Provider == "digitalocean" {
+		return DOLocations
+	}
+	return Locations
+}
+
+func (s *Server) Region() string {
+	r, ok := s.locations()[s.Location]
 	if !ok {
 		panic(fmt.Sprintf("invalid Server Location: %q", s.Location))
 	}
@@ -60,7 +105,7 @@ func (s *Server) String() string {
 	a := fmt.Sprintf("%s %s", s.Kind, s.Location)
 	if s.Instance != nil {
 		a += fmt.Sprintf(" (%s) (%s)",
-			s.Instance.InstanceId,
+			s.Instance.ID,
 			s.Instance.DNSName,
 		)
 	}
@@ -74,12 +119,24 @@ func (c *Config) ServerURL(s *Server) string {
 	return fmt.Sprintf("http://%s:%d/", s.Instance.DNSName, c.Icecast.ListenPort)
 }
 
-var Locations = map[string]aws.Region{
-	"Tokyo":     aws.APNortheast,
-	"Singapore": aws.APSoutheast,
-	"Europe":    aws.EUWest,
-	"USEast":    aws.USEast,
-	"USWest":    aws.USWest,
+// Locations translates the friendly location names used in config files
+// into the EC2 region names the AWS API expects.
+var Locations = map[string]string{
+	"Tokyo":     "ap-northeast-1",
+	"Singapore": "ap-southeast-1",
+	"Europe":    "eu-west-1",
+	"USEast":    "us-east-1",
+	"USWest":    "us-west-1",
+}
+
+// DOLocations translates the friendly location names used in config
+// files into the DigitalOcean region slugs its API expects.
+var DOLocations = map[string]string{
+	"NewYork":      "nyc3",
+	"SanFrancisco": "sfo3",
+	"Singapore":    "sgp1",
+	"Amsterdam":    "ams3",
+	"Frankfurt":    "fra1",
 }
 
 func ReadConfig(filename string) (*Config, error) {
@@ -92,16 +149,27 @@ func ReadConfig(filename string) (*Config, error) {
 	if err := json.Unmarshal(b, c); err != nil {
 		return nil, err
 	}
-
-	auth, err := aws.EnvAuth()
-	if err != nil {
-		return nil, err
+	c.vms = map[string]cloud.VMClient{
+		"ec2":          &cloud.EC2Client{Profile: c.Profile, RoleARN: c.RoleARN},
+		"digitalocean": &cloud.DOClient{Token: c.DOToken, SSHPublicKey: c.SSHPublicKey},
 	}
-	c.auth = auth
 
 	return c, nil
 }
 
+// vmClient returns the VMClient for s's provider.
+func (c *Config) vmClient(s *Server) (cloud.VMClient, error) {
+	p := s.Provider
+	if p == "" {
+		p = "ec2"
+	}
+	vc, ok := c.vms[p]
+	if !ok {
+		return nil, fmt.Errorf("%v: unknown provider %q", s, p)
+	}
+	return vc, nil
+}
+
 func (c *Config) Write(filename string) error {
 	b, err := json.MarshalIndent(c, "", "\t")
 	if err != nil {
@@ -110,18 +178,59 @@ func (c *Config) Write(filename string) error {
 	return ioutil.WriteFile(filename, b, 0600)
 }
 
+// masterServer returns the configured master server, or nil if none is
+// defined.
+func (c *Config) masterServer() *Server {
+	for _, s := range c.Server {
+		if s.Kind == "master" {
+			return s
+		}
+	}
+	return nil
+}
+
 func (c *Config) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	defer c.handleShutdownSignals(cancel, &wg)()
+
+	m := c.masterServer()
+	if m == nil {
+		return errors.New("no master found in config")
+	}
+
+	// The master is launched (and its DNS name resolved) before any
+	// slave, since each slave's cloud-init config needs to point its
+	// icecast relay at the master's address.
+	if err := inFlight(&wg, func() error { return c.runInstance(ctx, m) }); err != nil {
+		log.Println("run:", err)
+		log.Println("trying to shut down")
+		return c.safeShutdown()
+	}
+	if err := inFlight(&wg, func() error { return c.waitForDNSName(ctx, m) }); err != nil {
+		log.Println("run:", err)
+		log.Println("trying to shut down")
+		return c.safeShutdown()
+	}
+
 	for _, s := range c.Server {
-		if err := c.runInstance(s); err != nil {
+		if s.Kind == "master" {
+			continue
+		}
+		if err := inFlight(&wg, func() error { return c.runInstance(ctx, s) }); err != nil {
 			log.Println("run:", err)
 			log.Println("trying to shut down")
-			return c.Shutdown()
+			return c.safeShutdown()
 		}
 	}
+
 	done := make(chan *Server)
 	for _, s := range c.Server {
+		wg.Add(1)
 		go func(s *Server) {
-			if err := c.waitReady(s); err != nil {
+			defer wg.Done()
+			if err := c.waitReady(ctx, s); err != nil {
 				log.Printf("%v: %v", s, err)
 			} else {
 				log.Printf("%v: ready", s)
@@ -135,68 +244,169 @@ func (c *Config) Run() error {
 	return nil
 }
 
-func (c *Config) runInstance(s *Server) error {
-	e := ec2.New(c.auth, s.Region())
-	options := &ec2.RunInstances{
-		ImageId:      s.ImageID,
-		InstanceType: s.Size,
-		KeyName:      c.KeyName,
+// inFlight runs f while counted in wg, so a shutdown signal arriving
+// mid-call knows to wait for it before force-terminating anything.
+func inFlight(wg *sync.WaitGroup, f func() error) error {
+	wg.Add(1)
+	defer wg.Done()
+	return f()
+}
+
+// runInstance launches s's VM, passing along a cloud-init user-data
+// document (rendered by SetupTemplate) that installs and configures
+// icecast on first boot. No further action is required once the
+// instance is running: there's no setup script to upload and no SSH
+// session to open.
+func (c *Config) runInstance(ctx context.Context, s *Server) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	resp, err := e.RunInstances(options)
+	userData := new(bytes.Buffer)
+	var err error
+	if s.Kind == "master" {
+		err = SetupTemplate(userData, c.Icecast, s, nil)
+	} else {
+		m := c.masterServer()
+		if m == nil {
+			return errors.New("no master found in config")
+		}
+		if m.Instance == nil {
+			return errors.New("runInstance: master has no instance yet")
+		}
+		err = SetupTemplate(userData, c.Icecast, s, m)
+	}
+	if err != nil {
+		return err
+	}
+
+	vc, err := c.vmClient(s)
 	if err != nil {
 		return err
 	}
-	if len(resp.Instances) != 1 {
-		return fmt.Errorf("want 1 instance, got %d", len(resp.Instances))
+	vm, err := vc.Create(cloud.CreateOptions{
+		ImageID:      s.ImageID,
+		InstanceType: s.Size,
+		KeyName:      c.KeyName,
+		Region:       s.Region(),
+		UserData:     userData.Bytes(),
+	})
+	if err != nil {
+		return err
 	}
-	s.Instance = &resp.Instances[0]
+	c.mu.Lock()
+	s.Instance = vm
+	c.mu.Unlock()
 	return nil
 }
 
-func (c *Config) waitReady(s *Server) error {
+// waitForDNSName blocks until s's instance has been assigned a DNS name,
+// which is as much as we need to know about the master before rendering
+// the slaves' cloud-init documents.
+func (c *Config) waitForDNSName(ctx context.Context, s *Server) error {
+	vc, err := c.vmClient(s)
+	if err != nil {
+		return err
+	}
 	deadline := time.Now().Add(2 * time.Minute)
 	for time.Now().Before(deadline) {
-		inst, err := c.getInstance(s)
+		c.mu.Lock()
+		id := s.Instance.ID
+		c.mu.Unlock()
+		vm, err := vc.Describe(id, s.Region())
 		if err != nil {
 			return err
 		}
-		if inst.DNSName != "" {
+		c.mu.Lock()
+		s.Instance = vm
+		c.mu.Unlock()
+		if vm.DNSName != "" {
 			return nil
 		}
-		time.Sleep(5e9)
+		if err := sleepCtx(ctx, 5*time.Second); err != nil {
+			return err
+		}
+	}
+	return errors.New("waitForDNSName: server took too long to get a DNS name")
+}
+
+// sleepCtx sleeps for d, or returns ctx's error early if ctx is
+// cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return errors.New("waitReady: server took too long")
 }
 
-func (c *Config) getInstance(s *Server) (*ec2.Instance, error) {
-	e := ec2.New(c.auth, s.Region())
-	instIds := []string{s.Instance.InstanceId}
-	resp, err := e.Instances(instIds, nil)
+// waitReady waits, through the provider's WaitRunning, for s's instance
+// to be confirmed running, then makes a single check that its icecast
+// admin endpoint is responding; together these mean the cloud-init
+// bootstrap has finished successfully. A failed icecast check is not
+// retried here; setupServer retries waitReady as a whole.
+func (c *Config) waitReady(ctx context.Context, s *Server) error {
+	vc, err := c.vmClient(s)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(resp.Reservations) != 1 {
-		return nil, fmt.Errorf("getInstance: want 1 reservation, got %d", len(resp.Reservations))
+	c.mu.Lock()
+	id := s.Instance.ID
+	c.mu.Unlock()
+	vm, err := vc.WaitRunning(id, s.Region())
+	if err != nil {
+		return err
 	}
-	r := resp.Reservations[0]
-	if len(r.Instances) != 1 {
-		return nil, fmt.Errorf("getInstance: want 1 instance, got %d", len(r.Instances))
+	c.mu.Lock()
+	s.Instance = vm
+	c.mu.Unlock()
+
+	if !c.icecastUp(ctx, s) {
+		return errors.New("waitReady: icecast is not up yet")
 	}
-	s.Instance = &r.Instances[0]
-	return &r.Instances[0], nil
+	return nil
+}
+
+// icecastUp reports whether s's icecast admin status page is responding.
+func (c *Config) icecastUp(ctx context.Context, s *Server) bool {
+	if c.checkIcecast != nil {
+		return c.checkIcecast(s)
+	}
+	if s.Instance == nil || s.Instance.DNSName == "" || c.Icecast == nil {
+		return false
+	}
+	url := fmt.Sprintf("http://%s:%d/status-json.xsl", s.Instance.DNSName, c.Icecast.ListenPort)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
 }
 
 func (c *Config) Shutdown() error {
 	ok := true
 	for _, s := range c.Server {
-		if s.Instance == nil {
+		c.mu.Lock()
+		instance := s.Instance
+		c.mu.Unlock()
+		if instance == nil {
 			continue
 		}
-		e := ec2.New(c.auth, s.Region())
-		instIds := []string{s.Instance.InstanceId}
-		_, err := e.TerminateInstances(instIds)
+		vc, err := c.vmClient(s)
 		if err != nil {
-			log.Println(s.Instance.InstanceId, err)
+			log.Println(err)
+			ok = false
+			continue
+		}
+		if err := vc.Terminate(instance.ID, s.Region()); err != nil {
+			log.Println(instance.ID, err)
 			ok = false
 		}
 	}
@@ -206,74 +416,123 @@ func (c *Config) Shutdown() error {
 	return nil
 }
 
-func (c *Config) Setup() error {
-	ok := make(chan bool)
+// safeShutdown calls Shutdown, but only the first time it's called for
+// this Config. Run's own error-handling paths and a termination signal
+// arriving mid-Run can both end up wanting to shut everything down for
+// the same run; this keeps that down to one call instead of two
+// racing terminations.
+func (c *Config) safeShutdown() error {
+	var err error
+	c.shutdownOnce.Do(func() { err = c.Shutdown() })
+	return err
+}
+
+// Setup blocks until every server's cloud-init bootstrap has finished,
+// retrying each server's readiness check on its own schedule: instances
+// commonly refuse connections or report as pending for the first
+// 30-90 seconds after boot, so a single failed check isn't fatal.
+// retryTimeout bounds how long any one server is retried before it's
+// considered to have failed; sleep is the pause between attempts.
+// Since provisioning itself now happens via cloud-init at launch time
+// (see runInstance), Setup can also be re-run idempotently against an
+// existing state.json to converge servers a prior "run" gave up on.
+func (c *Config) Setup(retryTimeout, sleep time.Duration) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	defer c.handleShutdownSignals(cancel, &wg)()
+
+	done := make(chan error)
 	for _, s := range c.Server {
+		wg.Add(1)
 		go func(s *Server) {
-			err := c.setupInstance(s)
-			if err != nil {
-				log.Printf("%v: %v", s, err)
-				ok <- false
-			} else {
-				log.Printf("%v: online", s)
-				ok <- true
-			}
+			defer wg.Done()
+			done <- c.setupServer(ctx, s, retryTimeout, sleep)
 		}(s)
 	}
-	allOk := true
+	var errs []string
 	for _ = range c.Server {
-		k := <-ok
-		allOk = allOk && k
+		if err := <-done; err != nil {
+			errs = append(errs, err.Error())
+		}
 	}
-	if !allOk {
-		return errors.New("some instances didn't set up cleanly")
+	if len(errs) > 0 {
+		return fmt.Errorf("some servers never converged: %s", strings.Join(errs, "; "))
 	}
 	return nil
 }
 
-func (c *Config) setupInstance(s *Server) error {
-	// create the setup.sh script
-	stdin := new(bytes.Buffer)
-	var err error
-	if s.Kind == "master" {
-		err = SetupTemplate(stdin, c.Icecast, s, nil)
-	} else {
-		var m *Server
-		for _, n := range c.Server {
-			if n.Kind == "master" {
-				m = n
-				break
-			}
+// setupServer retries s's readiness check until it succeeds or
+// retryTimeout elapses, sleeping for sleep between attempts and logging
+// progress so operators can see why a "setup" run is taking a while.
+func (c *Config) setupServer(ctx context.Context, s *Server, retryTimeout, sleep time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(retryTimeout)
+	for attempt := 1; ; attempt++ {
+		err := c.waitReady(ctx, s)
+		if err == nil {
+			log.Printf("%v: ready (attempt %d, %v elapsed)", s, attempt, time.Since(start).Round(time.Second))
+			return nil
 		}
-		if m == nil {
-			return errors.New("no master found in config")
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%v: never converged after %d attempts: %v", s, attempt, err)
+		}
+		log.Printf("%v: attempt %d failed: %v (%v elapsed, %v remaining)",
+			s, attempt, err, time.Since(start).Round(time.Second), remaining.Round(time.Second))
+		if err := sleepCtx(ctx, sleep); err != nil {
+			return err
 		}
-		err = SetupTemplate(stdin, c.Icecast, s, m)
-	}
-	if err != nil {
-		return err
-	}
-	err = c.sshCommand(s, "cat > setup.sh", stdin)
-	if err != nil {
-		return err
 	}
-
-	// run it
-	return c.sshCommand(s, "bash setup.sh", nil)
 }
 
-func (c *Config) sshCommand(s *Server, command string, stdin io.Reader) error {
-	if s.Instance == nil {
-		return errors.New("sshCommand: nil instance")
-	}
-	userhost := fmt.Sprintf("%s@%s", s.Username, s.Instance.DNSName)
-	cmd := exec.Command("ssh", "-v", "-o", "StrictHostKeyChecking=no", userhost, command)
-	cmd.Stdin = stdin
-	b, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("%v: %s\n%s", s, command, b)
+// handleShutdownSignals installs handling of SIGINT, SIGTERM and SIGHUP
+// for the lifetime of one Run or Setup call. On receipt of a signal, it
+// cancels ctx so in-flight work can unwind, waits up to
+// shutdownGracePeriod for wg to drain, and then terminates every
+// instance provisioned so far regardless — this is what prevents a
+// Ctrl-C mid-run from leaking paid-for instances that never made it
+// into state.json. It persists the result to c.stateFile itself, since
+// the os.Exit below means main never gets the chance to. The returned
+// func must be called (typically via defer) to stop handling signals
+// once the caller returns normally.
+func (c *Config) handleShutdownSignals(cancel context.CancelFunc, wg *sync.WaitGroup) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("received %v, shutting down", sig)
+			cancel()
+
+			drained := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+			case <-time.After(shutdownGracePeriod):
+				log.Printf("grace period of %v elapsed, forcing termination", shutdownGracePeriod)
+			}
+
+			if err := c.safeShutdown(); err != nil {
+				log.Println("shutdown:", err)
+			}
+			if c.stateFile != "" {
+				if err := c.Write(c.stateFile); err != nil {
+					log.Println("shutdown: failed to persist state:", err)
+				}
+			}
+			os.Exit(1)
+		case <-stopped:
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(stopped)
 	}
-	return err
 }
 
 func (c *Config) Playlist(mount []string) error {
@@ -317,12 +576,17 @@ func (c *Config) writePlaylist(mount, ext string, t *template.Template) error {
 
 func main() {
 	stateFile := flag.String("state", "state.json", "file in which to store system state")
+	retryTimeout := flag.Duration("retry-timeout", 5*time.Minute, "how long to retry a server's setup before giving up on it")
+	sleep := flag.Duration("sleep", 5*time.Second, "how long to sleep between setup retry attempts")
+	addr := flag.String("addr", ":8080", "address for the serve verb's HTTP control API")
+	authToken := flag.String("auth-token", "", "bearer token required to call POST /shutdown/{name}")
 	flag.Parse()
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage: %v run configfile\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "       %v setup\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "       %v playlist\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "       %v shutdown\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %v serve\n", os.Args[0])
 		fmt.Fprintln(os.Stderr, "flags:")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -342,16 +606,22 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// *stateFile is always where this run's state ends up, regardless
+	// of which file the config itself was read from, so a signal
+	// handler or long-running serve can persist to it directly.
+	config.stateFile = *stateFile
 
 	switch verb {
 	case "run":
 		err = config.Run()
 	case "setup":
-		err = config.Setup()
+		err = config.Setup(*retryTimeout, *sleep)
 	case "playlist":
 		err = config.Playlist(flag.Args()[1:])
 	case "shutdown":
 		err = config.Shutdown()
+	case "serve":
+		err = config.Serve(*addr, *authToken)
 	default:
 		err = errors.New("invalid verb")
 	}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nf/icecloud/cloud"
+)
+
+func testConfig() *Config {
+	return &Config{
+		KeyName: "test-key",
+		Icecast: &Icecast{ListenPort: 8000},
+		Server: []*Server{
+			{Name: "m1", Kind: "master", Location: "USEast", ImageID: "ami-test", Size: "t1.micro"},
+			{Name: "s1", Kind: "slave", Location: "USEast", ImageID: "ami-test", Size: "t1.micro"},
+		},
+		vms: map[string]cloud.VMClient{
+			"ec2":          new(cloud.FakeClient),
+			"digitalocean": new(cloud.FakeClient),
+		},
+		checkIcecast: func(*Server) bool { return true },
+	}
+}
+
+func TestRunProvisionsMasterBeforeSlaves(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, s := range c.Server {
+		if s.Instance == nil {
+			t.Fatalf("%s: no instance assigned", s.Name)
+		}
+	}
+	// Both servers share one FakeClient, which numbers VMs in creation
+	// order, so the master must hold the first one.
+	if id := c.masterServer().Instance.ID; id != "i-fake1" {
+		t.Fatalf("master instance = %s, want i-fake1 (created first)", id)
+	}
+}
+
+func TestRunMixedProviders(t *testing.T) {
+	c := testConfig()
+	c.Server[1].Provider = "digitalocean"
+	c.Server[1].Location = "NewYork"
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	for _, s := range c.Server {
+		if s.Instance == nil {
+			t.Fatalf("%s: no instance assigned", s.Name)
+		}
+	}
+}
+
+func TestSetupRetriesUntilReady(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	var calls int32
+	c.checkIcecast = func(*Server) bool {
+		return atomic.AddInt32(&calls, 1) > 2
+	}
+	if err := c.Setup(time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+}
+
+func TestSetupGivesUpAfterRetryTimeout(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	c.checkIcecast = func(*Server) bool { return false }
+	if err := c.Setup(20*time.Millisecond, 5*time.Millisecond); err == nil {
+		t.Fatal("Setup: got nil error, want a timeout error")
+	}
+}
+
+func TestShutdownTerminatesInstances(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := c.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for _, s := range c.Server {
+		vc, err := c.vmClient(s)
+		if err != nil {
+			t.Fatalf("vmClient: %v", err)
+		}
+		vm, err := vc.Describe(s.Instance.ID, s.Region())
+		if err != nil {
+			t.Fatalf("Describe: %v", err)
+		}
+		if vm.State != "terminated" {
+			t.Errorf("%s: State = %q, want terminated", s.Name, vm.State)
+		}
+	}
+}
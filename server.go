@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/nf/icecloud/cloud"
+)
+
+// Serve starts an HTTP control API for the fleet: /servers reports the
+// current state, /playlist/{mount}.{m3u,pls} generates playlists
+// on-demand, /health polls each server's icecast status, and
+// POST /shutdown/{name} terminates a single server. It blocks until the
+// server exits, which only happens on a listen error.
+func (c *Config) Serve(addr, authToken string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/servers", c.handleServers)
+	mux.HandleFunc("/playlist/", c.handlePlaylist)
+	mux.HandleFunc("/health", c.handleHealth)
+	mux.HandleFunc("/shutdown/", requireBearerToken(authToken, c.handleShutdownServer))
+
+	log.Printf("serve: listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (c *Config) handleServers(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeJSON(w, c.Server)
+}
+
+// handlePlaylist serves /playlist/{mount}.{m3u,pls}, rendering the
+// playlist from the fleet's current state rather than a file written by
+// a previous run.
+func (c *Config) handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	mount, ext, ok := splitExt(strings.TrimPrefix(r.URL.Path, "/playlist/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var t *template.Template
+	switch ext {
+	case "m3u":
+		t = m3uTmpl
+		w.Header().Set("Content-Type", "audio/x-mpegurl")
+	case "pls":
+		t = plsTmpl
+		w.Header().Set("Content-Type", "audio/x-scpls")
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	urls := c.playlistURLs(mount)
+	if len(urls) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if err := t.Execute(w, urls); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// playlistURLs returns the stream URLs for every running slave carrying
+// mount, in configuration order.
+func (c *Config) playlistURLs(mount string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var urls []string
+	for _, s := range c.Server {
+		if s.Kind == "master" || s.Instance == nil {
+			continue
+		}
+		urls = append(urls, fmt.Sprintf("%s%s", c.ServerURL(s), mount))
+	}
+	return urls
+}
+
+// splitExt splits "mount.ext" into its mount and ext parts.
+func splitExt(name string) (mount, ext string, ok bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// ServerHealth reports one server's icecast health as seen by /health.
+type ServerHealth struct {
+	Name            string `json:"name"`
+	Up              bool   `json:"up"`
+	Listeners       int    `json:"listeners"`
+	SourceConnected bool   `json:"sourceConnected"`
+}
+
+func (c *Config) handleHealth(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	servers := append([]*Server(nil), c.Server...)
+	c.mu.Unlock()
+
+	health := make([]ServerHealth, len(servers))
+	for i, s := range servers {
+		health[i] = c.serverHealth(s)
+	}
+	writeJSON(w, health)
+}
+
+func (c *Config) serverHealth(s *Server) ServerHealth {
+	c.mu.Lock()
+	instance, icecast := s.Instance, c.Icecast
+	c.mu.Unlock()
+
+	h := ServerHealth{Name: s.Name}
+	if instance == nil || instance.DNSName == "" || icecast == nil {
+		return h
+	}
+	url := fmt.Sprintf("http://%s:%d/status-json.xsl", instance.DNSName, icecast.ListenPort)
+	resp, err := http.Get(url)
+	if err != nil {
+		return h
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return h
+	}
+	var status icecastStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return h
+	}
+	sources := status.sources()
+	h.Up = true
+	h.SourceConnected = len(sources) > 0
+	for _, src := range sources {
+		h.Listeners += src.Listeners
+	}
+	return h
+}
+
+// icecastStatus is the relevant subset of status-json.xsl's response.
+// icecast reports "source" as a single object when there's exactly one
+// mount and as an array otherwise, so Source is decoded lazily by
+// sources.
+type icecastStatus struct {
+	Icestats struct {
+		Source json.RawMessage `json:"source"`
+	} `json:"icestats"`
+}
+
+type icecastSource struct {
+	Listeners int `json:"listeners"`
+}
+
+func (s *icecastStatus) sources() []icecastSource {
+	var one icecastSource
+	if json.Unmarshal(s.Icestats.Source, &one) == nil && len(s.Icestats.Source) > 0 && s.Icestats.Source[0] == '{' {
+		return []icecastSource{one}
+	}
+	var many []icecastSource
+	json.Unmarshal(s.Icestats.Source, &many)
+	return many
+}
+
+// handleShutdownServer terminates the named server's instance. It's
+// guarded by requireBearerToken, since it's the one endpoint that costs
+// real money if anyone can call it. The resulting state is persisted to
+// c.stateFile immediately, since Serve has no other point at which it
+// returns control to main's own config.Write call.
+func (c *Config) handleShutdownServer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/shutdown/")
+
+	c.mu.Lock()
+	var s *Server
+	for _, cand := range c.Server {
+		if cand.Name == name {
+			s = cand
+			break
+		}
+	}
+	var instance *cloud.VM
+	if s != nil {
+		instance = s.Instance
+	}
+	c.mu.Unlock()
+
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if instance == nil {
+		http.Error(w, fmt.Sprintf("%s: not running", name), http.StatusConflict)
+		return
+	}
+	vc, err := c.vmClient(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := vc.Terminate(instance.ID, s.Region()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.mu.Lock()
+	s.Instance = nil
+	c.mu.Unlock()
+
+	if c.stateFile != "" {
+		if err := c.Write(c.stateFile); err != nil {
+			log.Println("shutdown:", name, "failed to persist state:", err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireBearerToken wraps next so it's only reachable with a request
+// carrying "Authorization: Bearer <token>". An empty token never
+// authorizes anything, so --auth-token must be set to use guarded
+// endpoints at all.
+func requireBearerToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		got := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(got, prefix) || got[len(prefix):] != token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("writeJSON:", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSplitExt(t *testing.T) {
+	cases := []struct {
+		name       string
+		mount, ext string
+		ok         bool
+	}{
+		{"stream.m3u", "stream", "m3u", true},
+		{"my.mount.pls", "my.mount", "pls", true},
+		{"noext", "", "", false},
+	}
+	for _, c := range cases {
+		mount, ext, ok := splitExt(c.name)
+		if mount != c.mount || ext != c.ext || ok != c.ok {
+			t.Errorf("splitExt(%q) = %q, %q, %v, want %q, %q, %v", c.name, mount, ext, ok, c.mount, c.ext, c.ok)
+		}
+	}
+}
+
+func TestIcecastStatusSources(t *testing.T) {
+	single := &icecastStatus{}
+	single.Icestats.Source = []byte(`{"listeners":3}`)
+	if got := single.sources(); len(got) != 1 || got[0].Listeners != 3 {
+		t.Errorf("single source: got %+v", got)
+	}
+
+	many := &icecastStatus{}
+	many.Icestats.Source = []byte(`[{"listeners":1},{"listeners":2}]`)
+	if got := many.sources(); len(got) != 2 || got[0].Listeners != 1 || got[1].Listeners != 2 {
+		t.Errorf("multiple sources: got %+v", got)
+	}
+}
+
+func TestPlaylistURLs(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	urls := c.playlistURLs("stream")
+	if len(urls) != 1 {
+		t.Fatalf("playlistURLs = %v, want 1 slave URL", urls)
+	}
+}
+
+func TestHandleShutdownServerRequiresToken(t *testing.T) {
+	c := testConfig()
+	if err := c.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	srv := httptest.NewServer(requireBearerToken("secret", c.handleShutdownServer))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL+"/shutdown/s1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("with token: status = %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	var s1 *Server
+	for _, s := range c.Server {
+		if s.Name == "s1" {
+			s1 = s
+		}
+	}
+	if s1.Instance != nil {
+		t.Fatalf("s1 still has an instance after shutdown")
+	}
+}
@@ -1,121 +1,152 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"net/textproto"
 	"text/template"
 )
 
+// SetupTemplate renders the cloud-init user-data document that bootstraps
+// a fresh instance into an icecast server. It's a MIME multipart message
+// with a #cloud-config part (which installs the icecast2 package and
+// writes its configuration) and a shell part (which restarts the service
+// once the config files are in place).
 func SetupTemplate(w io.Writer, icecast *Icecast, server, master *Server) error {
-	err := setupTmpl.Execute(w, struct {
+	data := struct {
 		Icecast        *Icecast
 		Server, Master *Server
-	}{icecast, server, master})
-	if err != nil {
+	}{icecast, server, master}
+
+	cloudConfig := new(bytes.Buffer)
+	if err := cloudConfigTmpl.Execute(cloudConfig, data); err != nil {
+		return fmt.Errorf("SetupTemplate: %v", err)
+	}
+	restart := new(bytes.Buffer)
+	if err := restartTmpl.Execute(restart, data); err != nil {
 		return fmt.Errorf("SetupTemplate: %v", err)
 	}
-	return nil
-}
 
-var setupTmpl *template.Template
+	mw := multipart.NewWriter(w)
+	fmt.Fprintf(w, "Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n", mw.Boundary())
+	if err := writeUserDataPart(mw, "cloud-config.txt", "text/cloud-config", cloudConfig.Bytes()); err != nil {
+		return fmt.Errorf("SetupTemplate: %v", err)
+	}
+	if err := writeUserDataPart(mw, "restart-icecast.sh", "text/x-shellscript", restart.Bytes()); err != nil {
+		return fmt.Errorf("SetupTemplate: %v", err)
+	}
+	return mw.Close()
+}
 
-func init() {
-	setupTmpl = template.New("setup")
-	template.Must(setupTmpl.Parse(setupText))
+func writeUserDataPart(mw *multipart.Writer, filename, contentType string, body []byte) error {
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+`; charset="us-ascii"`)
+	h.Set("MIME-Version", "1.0")
+	h.Set("Content-Transfer-Encoding", "7bit")
+	h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(body)
+	return err
 }
 
-const setupText = `#!/bin/bash
-
-sudo apt-get -qq -y install icecast2
-
-cat > etc_icecast2_icecast.xml <<EOF
-<icecast>
-    <limits>
-        <clients>{{.Server.NumClients}}</clients>
-        <sources>{{.Server.NumSources}}</sources>
-        <threadpool>5</threadpool>
-        <queue-size>524288</queue-size>
-        <client-timeout>30</client-timeout>
-        <header-timeout>15</header-timeout>
-        <source-timeout>10</source-timeout>
-        <burst-on-connect>1</burst-on-connect>
-        <burst-size>65535</burst-size>
-    </limits>
-
-    <authentication>
-        <!-- Sources log in with username 'source' -->
-        <source-password>{{.Icecast.SourcePassword}}</source-password>
-        <!-- Relays log in username 'relay' -->
-        <relay-password>{{.Icecast.RelayPassword}}</relay-password>
-        <!-- Admin logs in with the username given below -->
-        <admin-user>admin</admin-user>
-        <admin-password>{{.Icecast.AdminPassword}}</admin-password>
-    </authentication>
-
-    <hostname>{{.Server.Instance.DNSName}}</hostname>
-
-    <listen-socket>
-        <port>{{.Icecast.ListenPort}}</port>
-    </listen-socket>
-
-{{if .Master}}
-    <master-server>{{.Master.Instance.DNSName}}</master-server>
-    <master-server-port>{{.Icecast.ListenPort}}</master-server-port>
-    <master-update-interval>5</master-update-interval>
-    <master-password>{{.Icecast.RelayPassword}}</master-password>
-{{end}}
+var cloudConfigTmpl = template.Must(template.New("cloud-config").Parse(cloudConfigText))
+var restartTmpl = template.Must(template.New("restart").Parse(restartText))
+
+const cloudConfigText = `#cloud-config
+packages:
+  - icecast2
+
+write_files:
+  - path: /etc/icecast2/icecast.xml
+    owner: icecast2:icecast
+    permissions: '0660'
+    content: |
+      <icecast>
+          <limits>
+              <clients>{{.Server.NumClients}}</clients>
+              <sources>{{.Server.NumSources}}</sources>
+              <threadpool>5</threadpool>
+              <queue-size>524288</queue-size>
+              <client-timeout>30</client-timeout>
+              <header-timeout>15</header-timeout>
+              <source-timeout>10</source-timeout>
+              <burst-on-connect>1</burst-on-connect>
+              <burst-size>65535</burst-size>
+          </limits>
+
+          <authentication>
+              <!-- Sources log in with username 'source' -->
+              <source-password>{{.Icecast.SourcePassword}}</source-password>
+              <!-- Relays log in username 'relay' -->
+              <relay-password>{{.Icecast.RelayPassword}}</relay-password>
+              <!-- Admin logs in with the username given below -->
+              <admin-user>admin</admin-user>
+              <admin-password>{{.Icecast.AdminPassword}}</admin-password>
+          </authentication>
+
+          <listen-socket>
+              <port>{{.Icecast.ListenPort}}</port>
+          </listen-socket>
+
+      {{if .Master}}
+          <master-server>{{.Master.Instance.DNSName}}</master-server>
+          <master-server-port>{{.Icecast.ListenPort}}</master-server-port>
+          <master-update-interval>5</master-update-interval>
+          <master-password>{{.Icecast.RelayPassword}}</master-password>
+      {{end}}
+
+          <fileserve>1</fileserve>
+
+          <paths>
+              <logdir>/var/log/icecast2</logdir>
+              <webroot>/usr/share/icecast2/web</webroot>
+              <adminroot>/usr/share/icecast2/admin</adminroot>
+              <alias source="/" dest="/status.xsl"/>
+          </paths>
+
+          <logging>
+              <accesslog>access.log</accesslog>
+              <errorlog>error.log</errorlog>
+              <loglevel>3</loglevel> <!-- 4 Debug, 3 Info, 2 Warn, 1 Error -->
+              <logsize>10000</logsize> <!-- Max size of a logfile -->
+              <logarchive>1</logarchive>
+          </logging>
+
+          <security>
+              <chroot>0</chroot>
+          </security>
+      </icecast>
+  - path: /etc/default/icecast2
+    owner: root:root
+    permissions: '0644'
+    content: |
+      # Defaults for icecast2 initscript
+      # sourced by /etc/init.d/icecast2
+      # installed at /etc/default/icecast2 by the maintainer scripts
+
+      #
+      # This is a POSIX shell fragment
+      #
+
+      # Full path to the server configuration file
+      CONFIGFILE="/etc/icecast2/icecast.xml"
+
+      # Name or ID of the user and group the daemon should run under
+      USERID=icecast2
+      GROUPID=icecast
+
+      # Edit /etc/icecast2/icecast.xml and change at least the passwords.
+      # Change this to true when done to enable the init.d script
+      ENABLE=true
+`
 
-    <fileserve>1</fileserve>
-
-    <paths>
-        <logdir>/var/log/icecast2</logdir>
-        <webroot>/usr/share/icecast2/web</webroot>
-        <adminroot>/usr/share/icecast2/admin</adminroot>
-        <alias source="/" dest="/status.xsl"/>
-    </paths>
-
-    <logging>
-        <accesslog>access.log</accesslog>
-        <errorlog>error.log</errorlog>
-      	<loglevel>3</loglevel> <!-- 4 Debug, 3 Info, 2 Warn, 1 Error -->
-      	<logsize>10000</logsize> <!-- Max size of a logfile -->
-        <logarchive>1</logarchive>
-    </logging>
-
-    <security>
-        <chroot>0</chroot>
-    </security>
-</icecast>
-EOF
-
-cat > etc_default_icecast2 <<EOF
-# Defaults for icecast2 initscript
-# sourced by /etc/init.d/icecast2
-# installed at /etc/default/icecast2 by the maintainer scripts
-
-#
-# This is a POSIX shell fragment
-#
-
-# Full path to the server configuration file
-CONFIGFILE="/etc/icecast2/icecast.xml"
-
-# Name or ID of the user and group the daemon should run under
-USERID=icecast2
-GROUPID=icecast
-
-# Edit /etc/icecast2/icecast.xml and change at least the passwords.
-# Change this to true when done to enable the init.d script
-ENABLE=true
-
-EOF
-
-sudo cp etc_default_icecast2 /etc/default/icecast2
-sudo cp etc_icecast2_icecast.xml /etc/icecast2/icecast.xml
-sudo chown icecast2:icecast /etc/icecast2/icecast.xml
-sudo chmod 660 /etc/icecast2/icecast.xml
-
-sudo /etc/init.d/icecast2 restart
+const restartText = `#!/bin/bash
+service icecast2 restart
 `
 
 var m3uTmpl = template.Must(template.New("m3u").Parse(